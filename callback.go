@@ -0,0 +1,44 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// oauthCallbackHandler is the handler registered against the oauth callback
+// URI. It verifies the signed, cookie-bound state parameter before trusting
+// the path it encodes, rejecting tampered, replayed or expired state with a
+// 403 rather than redirecting the browser to a path the verified state
+// hasn't vouched for
+func (r *oauthProxy) oauthCallbackHandler(w http.ResponseWriter, req *http.Request) context.Context {
+	state := req.URL.Query().Get("state")
+	if state == "" {
+		r.log.Error("rejecting oauth callback, no state parameter present")
+		return r.accessForbidden(w, req)
+	}
+
+	redirectPath, err := r.pathFromStateParam(req, state)
+	if err != nil {
+		r.log.Error("rejecting oauth callback, invalid state parameter", zap.Error(err))
+		return r.accessForbidden(w, req)
+	}
+
+	return r.redirectToURL(redirectPath, w, req)
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// maxCookieChunkSize is the largest value we will place in a single cookie
+// before splitting it into numbered chunks, kept comfortably under the
+// ~4KB per-cookie limit enforced by most browsers
+const maxCookieChunkSize = 3800
+
+// writeCookie writes value as a single cookie named name, or, if it exceeds
+// maxCookieChunkSize, splits it across <name>_0, <name>_1, ... cookies. Every
+// chunk shares the same expiry so they expire atomically
+func writeCookie(w http.ResponseWriter, name, value string, expiration time.Duration) {
+	expires := time.Now().Add(expiration)
+
+	if len(value) <= maxCookieChunkSize {
+		http.SetCookie(w, makeCookie(name, value, expires))
+		return
+	}
+
+	for i, chunk := 0, 0; i < len(value); i, chunk = i+maxCookieChunkSize, chunk+1 {
+		end := i + maxCookieChunkSize
+		if end > len(value) {
+			end = len(value)
+		}
+		http.SetCookie(w, makeCookie(fmt.Sprintf("%s_%d", name, chunk), value[i:end], expires))
+	}
+}
+
+// makeCookie builds the http.Cookie used for both chunked and unchunked values
+func makeCookie(name, value string, expires time.Time) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+		Expires:  expires,
+	}
+}
+
+// dropAccessTokenCookie writes the access token cookie, AES-GCM encrypting
+// the value first when EnableEncryptedToken is switched on, and transparently
+// chunking it across <name>_0, <name>_1, ... cookies when it exceeds the
+// per-cookie browser limit (large encrypted tokens or JWTs with many claims)
+func (r *oauthProxy) dropAccessTokenCookie(w http.ResponseWriter, value string, duration time.Duration) {
+	if r.config.EnableEncryptedToken {
+		encrypted, err := encryptToken([]byte(r.config.EncryptionKey), value)
+		if err != nil {
+			r.log.Error("failed to encrypt access token cookie", zap.Error(err))
+			return
+		}
+		value = encrypted
+	}
+
+	writeCookie(w, r.config.CookieAccessName, value, duration)
+}
+
+// getAccessTokenFromCookie reassembles the access token cookie written by
+// dropAccessTokenCookie, joining its chunks back together and transparently
+// decrypting it when EnableEncryptedToken is switched on
+func (r *oauthProxy) getAccessTokenFromCookie(req *http.Request) (string, error) {
+	value, err := readCookie(req, r.config.CookieAccessName)
+	if err != nil {
+		return "", err
+	}
+
+	if r.config.EnableEncryptedToken {
+		return decryptToken([]byte(r.config.EncryptionKey), value)
+	}
+
+	return value, nil
+}
+
+// readCookie reconstructs a value previously written by writeCookie, joining
+// any <name>_0, <name>_1, ... chunks back together in order. A plain,
+// unchunked cookie named name takes precedence; the chunks are only read
+// when it is absent
+func readCookie(req *http.Request, name string) (string, error) {
+	if cookie, err := req.Cookie(name); err == nil {
+		return cookie.Value, nil
+	}
+
+	var chunks []string
+	for i := 0; ; i++ {
+		cookie, err := req.Cookie(fmt.Sprintf("%s_%d", name, i))
+		if err != nil {
+			break
+		}
+		chunks = append(chunks, cookie.Value)
+	}
+	if len(chunks) == 0 {
+		return "", http.ErrNoCookie
+	}
+
+	return strings.Join(chunks, ""), nil
+}
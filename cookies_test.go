@@ -0,0 +1,106 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteAndReadCookieChunking(t *testing.T) {
+	sizes := map[string]int{
+		"8KB":  8 * 1024,
+		"16KB": 16 * 1024,
+	}
+
+	for label, size := range sizes {
+		t.Run(label, func(t *testing.T) {
+			value := strings.Repeat("a", size)
+
+			rec := httptest.NewRecorder()
+			writeCookie(rec, "kc-access", value, time.Minute)
+
+			result := rec.Result()
+			if len(result.Cookies()) < 2 {
+				t.Fatalf("expected %s payload to be split into multiple chunks, got %d cookies", label, len(result.Cookies()))
+			}
+			for _, c := range result.Cookies() {
+				if len(c.Value) > maxCookieChunkSize {
+					t.Fatalf("chunk %s exceeds maxCookieChunkSize: %d bytes", c.Name, len(c.Value))
+				}
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			for _, c := range result.Cookies() {
+				req.AddCookie(c)
+			}
+
+			got, err := readCookie(req, "kc-access")
+			if err != nil {
+				t.Fatalf("unexpected error reading chunked cookie: %v", err)
+			}
+			if got != value {
+				t.Fatalf("reassembled cookie value did not match original %s payload", label)
+			}
+		})
+	}
+}
+
+func TestWriteCookieChunksShareExpiration(t *testing.T) {
+	value := strings.Repeat("b", 10*1024)
+	duration := 5 * time.Minute
+
+	rec := httptest.NewRecorder()
+	writeCookie(rec, "kc-access", value, duration)
+
+	cookies := rec.Result().Cookies()
+	if len(cookies) < 2 {
+		t.Fatalf("expected chunked cookies")
+	}
+	first := cookies[0].Expires
+	for _, c := range cookies[1:] {
+		if !c.Expires.Equal(first) {
+			t.Fatalf("expected all chunks to share the same expiration, got %v and %v", first, c.Expires)
+		}
+	}
+}
+
+func TestFilterCookiesCensorsChunks(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(&http.Cookie{Name: "kc-access_0", Value: "secret-part-1"})
+	req.AddCookie(&http.Cookie{Name: "kc-access_1", Value: "secret-part-2"})
+	req.AddCookie(&http.Cookie{Name: "unrelated", Value: "keep-me"})
+
+	if err := filterCookies(req, []string{"kc-access"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, c := range req.Cookies() {
+		switch c.Name {
+		case "kc-access_0", "kc-access_1":
+			if c.Value != "censored" {
+				t.Fatalf("expected chunk %s to be censored, got %q", c.Name, c.Value)
+			}
+		case "unrelated":
+			if c.Value != "keep-me" {
+				t.Fatalf("expected unrelated cookie to be untouched")
+			}
+		}
+	}
+}
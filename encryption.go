@@ -0,0 +1,103 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+)
+
+// encryptionNonceSize is the size, in bytes, of the random nonce prepended
+// to the ciphertext of every encrypted token
+const encryptionNonceSize = 12
+
+// encryptToken AES-GCM encrypts the plaintext token with the configured
+// EncryptionKey and returns a base64-url-encoded, nonce-prefixed ciphertext
+// suitable for storing in a cookie
+func encryptToken(key []byte, plaintext string) (string, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, encryptionNonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	ciphertext := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+
+	return base64.RawURLEncoding.EncodeToString(ciphertext), nil
+}
+
+// decryptToken reverses encryptToken, returning the original plaintext token
+func decryptToken(key []byte, encoded string) (string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+
+	if len(raw) < encryptionNonceSize {
+		return "", errors.New("encrypted token is too short")
+	}
+	nonce, ciphertext := raw[:encryptionNonceSize], raw[encryptionNonceSize:]
+
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return string(plaintext), nil
+}
+
+// validateEncryptionKey ensures the configured EncryptionKey is a valid
+// AES key length (16 or 32 bytes), as required by EnableEncryptedToken
+func validateEncryptionKey(key string) error {
+	switch len(key) {
+	case 16, 32:
+		return nil
+	default:
+		return errors.New("encryption key must be exactly 16 or 32 bytes")
+	}
+}
+
+// validateEncryptionConfig checks the configured EncryptionKey unconditionally
+// - EncryptionKey backs both the optional access-token cookie encryption and
+// the oauth state parameter signing key derived in stateSigningKey, and the
+// latter is always in use regardless of EnableEncryptedToken. It's called
+// once during proxy construction so a misconfigured key fails fast at
+// startup rather than surfacing as a hard-to-diagnose signature mismatch
+// deep inside a request
+func (r *oauthProxy) validateEncryptionConfig() error {
+	return validateEncryptionKey(r.config.EncryptionKey)
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEncryptDecryptTokenRoundTrip(t *testing.T) {
+	key := []byte("AgBD6987FqHDB3normzfqHDB3normzfA")
+
+	encrypted, err := encryptToken(key, "my-access-token")
+	if err != nil {
+		t.Fatalf("unexpected error encrypting token: %v", err)
+	}
+
+	decrypted, err := decryptToken(key, encrypted)
+	if err != nil {
+		t.Fatalf("unexpected error decrypting token: %v", err)
+	}
+	if decrypted != "my-access-token" {
+		t.Fatalf("expected decrypted token to match, got: %s", decrypted)
+	}
+}
+
+func TestDecryptTokenRejectsTamperedCiphertext(t *testing.T) {
+	key := []byte("AgBD6987FqHDB3normzfqHDB3normzfA")
+
+	encrypted, err := encryptToken(key, "my-access-token")
+	if err != nil {
+		t.Fatalf("unexpected error encrypting token: %v", err)
+	}
+
+	mid := len(encrypted) / 2
+	tampered := encrypted[:mid] + "x" + encrypted[mid+1:]
+	if tampered == encrypted {
+		tampered = encrypted[:mid] + "y" + encrypted[mid+1:]
+	}
+
+	if _, err := decryptToken(key, tampered); err == nil {
+		t.Fatalf("expected a tampered ciphertext to be rejected")
+	}
+}
+
+func TestDecryptTokenRejectsWrongKey(t *testing.T) {
+	encrypted, err := encryptToken([]byte("AgBD6987FqHDB3normzfqHDB3normzfA"), "my-access-token")
+	if err != nil {
+		t.Fatalf("unexpected error encrypting token: %v", err)
+	}
+
+	if _, err := decryptToken([]byte("differentkeydifferentkeydifferen"), encrypted); err == nil {
+		t.Fatalf("expected decryption with the wrong key to be rejected")
+	}
+}
+
+func TestValidateEncryptionKey(t *testing.T) {
+	cases := []struct {
+		name    string
+		key     string
+		wantErr bool
+	}{
+		{name: "16 bytes", key: strings.Repeat("a", 16), wantErr: false},
+		{name: "32 bytes", key: strings.Repeat("a", 32), wantErr: false},
+		{name: "too short", key: strings.Repeat("a", 8), wantErr: true},
+		{name: "in between", key: strings.Repeat("a", 24), wantErr: true},
+		{name: "empty", key: "", wantErr: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := validateEncryptionKey(c.key)
+			if c.wantErr && err == nil {
+				t.Fatalf("expected an error for key length %d", len(c.key))
+			}
+			if !c.wantErr && err != nil {
+				t.Fatalf("unexpected error for key length %d: %v", len(c.key), err)
+			}
+		})
+	}
+}
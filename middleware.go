@@ -0,0 +1,84 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// patRefreshStart ensures patRefreshLoop is only ever launched once, the
+// first time a request comes in needing UMA authorization
+var patRefreshStart sync.Once
+
+// sessionStoreStart ensures the default in-memory session store is only
+// ever created once, the first time a request needs idle-session tracking
+var sessionStoreStart sync.Once
+
+// tracingStart ensures the OTLP tracer provider is only ever configured
+// once, the first time a request comes in with tracing switched on
+var tracingStart sync.Once
+
+// entrypointMiddleware performs the cross-cutting checks (UMA authorization,
+// idle-session expiry, tracing, ...) that run once a request has been
+// authenticated. UMA and idle-session checks both need the verified identity
+// the standard authentication middleware places on RequestScope, so this
+// must be mounted innermost - after that middleware, immediately in front of
+// the reverse proxy handler - not before it
+func (r *oauthProxy) entrypointMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if r.config.EnableTracing {
+			tracingStart.Do(func() {
+				if _, err := newTracerProvider(r.config.TracingEndpoint, r.config.TracingServiceName, r.config.TracingSampleRate); err != nil {
+					r.log.Error("failed to configure the tracer provider", zap.Error(err))
+				}
+			})
+
+			ctx, span := r.startRootSpan(req)
+			defer span.End()
+			req = req.WithContext(ctx)
+		}
+
+		if r.config.EnableUma {
+			patRefreshStart.Do(func() { go r.patRefreshLoop(r.stopCh) })
+
+			ctx := r.umaAuthorized(w, req)
+			if scope, ok := ctx.Value(contextScopeName).(*RequestScope); ok && scope.AccessDenied {
+				return
+			}
+			req = req.WithContext(ctx)
+		}
+
+		if r.config.SessionIdleDuration > 0 {
+			sessionStoreStart.Do(func() {
+				if r.sessions == nil {
+					r.sessions = newMemorySessionStore(r.config.SessionIdleDuration)
+				}
+			})
+
+			if scope, ok := req.Context().Value(contextScopeName).(*RequestScope); ok && !scope.AccessDenied {
+				if expired := r.checkRequestIdleSession(w, req, scope); expired {
+					r.redirectToAuthorization(w, req)
+					return
+				}
+			}
+		}
+
+		next.ServeHTTP(w, req)
+	})
+}
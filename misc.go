@@ -17,19 +17,35 @@ package main
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"path"
+	"strconv"
 	"time"
 
 	"github.com/gambol99/go-oidc/jose"
+	"go.opentelemetry.io/otel/attribute"
 	"go.uber.org/zap"
+	"golang.org/x/crypto/hkdf"
 	"strings"
 )
 
 const PathParamPrefix = ":path:"
 
+// stateCookieName is the cookie used to bind the oauth state nonce to the
+// browser session so the callback can detect CSRF/replay attempts
+const stateCookieName = "kc-oauth-state"
+
+// stateNonceBytes is the amount of entropy used for the state nonce
+const stateNonceBytes = 32
+
 // filterCookies is responsible for censoring any cookies we don't want sent
 func filterCookies(req *http.Request, filter []string) error {
 	// @NOTE: there doesn't appear to be a way of removing a cookie from the http.Request as
@@ -40,9 +56,11 @@ func filterCookies(req *http.Request, filter []string) error {
 	// @step: iterate the cookies and filter out anything we
 	for _, x := range cookies {
 		var found bool
-		// @step: does this cookie match our filter?
+		// @step: does this cookie match our filter? cookies chunked by
+		// writeCookie are named <name>_0, <name>_1, ... so we match on
+		// the chunk prefix as well as the exact name
 		for _, n := range filter {
-			if x.Name == n {
+			if x.Name == n || strings.HasPrefix(x.Name, n+"_") {
 				req.AddCookie(&http.Cookie{Name: x.Name, Value: "censored"})
 				found = true
 				break
@@ -58,6 +76,9 @@ func filterCookies(req *http.Request, filter []string) error {
 
 // revokeProxy is responsible to stopping the middleware from proxying the request
 func (r *oauthProxy) revokeProxy(w http.ResponseWriter, req *http.Request) context.Context {
+	_, span := r.startChildSpan(req, "revokeProxy", "revoke", "proxying stopped")
+	defer span.End()
+
 	var scope *RequestScope
 	sc := req.Context().Value(contextScopeName)
 	switch sc {
@@ -68,11 +89,20 @@ func (r *oauthProxy) revokeProxy(w http.ResponseWriter, req *http.Request) conte
 	}
 	scope.AccessDenied = true
 
+	if state := req.URL.Query().Get("state"); state != "" {
+		if decodedPath, err := r.pathFromStateParam(req, state); err == nil {
+			span.SetAttributes(attribute.String("keycloak_proxy.state_path", decodedPath))
+		}
+	}
+
 	return context.WithValue(req.Context(), contextScopeName, scope)
 }
 
 // accessForbidden redirects the user to the forbidden page
 func (r *oauthProxy) accessForbidden(w http.ResponseWriter, req *http.Request) context.Context {
+	_, span := r.startChildSpan(req, "accessForbidden", "forbidden", "access denied")
+	defer span.End()
+
 	w.WriteHeader(http.StatusForbidden)
 	// are we using a custom http template for 403?
 	if r.config.hasCustomForbiddenPage() {
@@ -94,12 +124,15 @@ func (r *oauthProxy) redirectToURL(url string, w http.ResponseWriter, req *http.
 
 // redirectToAuthorization redirects the user to authorization handler
 func (r *oauthProxy) redirectToAuthorization(w http.ResponseWriter, req *http.Request) context.Context {
+	_, span := r.startChildSpan(req, "redirectToAuthorization", "redirect", "requires authorization")
+	defer span.End()
+
 	if r.config.NoRedirects {
 		w.WriteHeader(http.StatusUnauthorized)
 		return r.revokeProxy(w, req)
 	}
 	// step: add a state referrer to the authorization page
-	authQuery := fmt.Sprintf("?state=%s", r.generateStateParam(req.URL.RequestURI()))
+	authQuery := fmt.Sprintf("?state=%s", r.generateStateParam(w, req.URL.RequestURI()))
 
 	// step: if verification is switched off, we can't authorization
 	if r.config.SkipTokenVerification {
@@ -122,22 +155,112 @@ func (r *oauthProxy) getAccessCookieExpiration(token jose.JWT, refresh string) t
 		duration = time.Until(ident.ExpiresAt)
 	}
 
+	// notes: if an idle timeout is configured, the cookie must not outlive it -
+	// the access cookie's lifetime becomes the shorter of the two, so an idle
+	// session expires after SessionIdleDuration while an active one, whose
+	// cookie is re-issued, still expires at the refresh token's absolute lifetime
+	if r.config.SessionIdleDuration > 0 && r.config.SessionIdleDuration < duration {
+		duration = r.config.SessionIdleDuration
+	}
+
 	return duration
 }
 
-// generateStateParam creates a new base64-encoded value to use as the `state`
-// query parameter for an auth redirect
-func (r *oauthProxy) generateStateParam(uri string) string {
-	state := PathParamPrefix + uri
+// generateStateParam creates a signed, nonce-bound value to use as the
+// `state` query parameter for an auth redirect. The nonce is also written as
+// a short-lived cookie so the callback can detect CSRF/replay attempts
+func (r *oauthProxy) generateStateParam(w http.ResponseWriter, uri string) string {
+	nonce := make([]byte, stateNonceBytes)
+	// @NOTE: crypto/rand.Read never returns a short read or recoverable error
+	rand.Read(nonce)
+	encodedNonce := base64.RawURLEncoding.EncodeToString(nonce)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     stateCookieName,
+		Value:    encodedNonce,
+		Path:     "/",
+		MaxAge:   int(r.config.OAuthStateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	issuedAt := strconv.FormatInt(time.Now().Unix(), 10)
+	// @NOTE: the path is base64-encoded before joining so an embedded "|" in
+	// the path can't be confused with the field separator when parsed back
+	encodedPath := base64.RawURLEncoding.EncodeToString([]byte(PathParamPrefix + uri))
+	payload := strings.Join([]string{encodedNonce, issuedAt, encodedPath}, "|")
+	state := payload + "|" + r.signStateParam(payload)
+
 	return base64.RawURLEncoding.EncodeToString([]byte(state))
 }
 
-// pathFromStateParam returns the encoded path from a state value created by a
-// prior call to generateStateParam
-func (r *oauthProxy) pathFromStateParam(state string) (string, error) {
+// pathFromStateParam verifies the signature, nonce and age of a state value
+// created by a prior call to generateStateParam and returns the encoded path.
+// It rejects tampered, replayed (nonce doesn't match the `kc-oauth-state`
+// cookie) or expired (older than OAuthStateTTL) state values
+func (r *oauthProxy) pathFromStateParam(req *http.Request, state string) (string, error) {
 	decoded, err := base64.RawURLEncoding.DecodeString(state)
 	if err != nil {
 		return "", err
 	}
-	return strings.TrimPrefix(string(decoded), PathParamPrefix), nil
+
+	parts := strings.SplitN(string(decoded), "|", 4)
+	if len(parts) != 4 {
+		return "", errors.New("malformed state parameter")
+	}
+	nonce, issuedAt, encodedPath, signature := parts[0], parts[1], parts[2], parts[3]
+
+	expected := r.signStateParam(strings.Join([]string{nonce, issuedAt, encodedPath}, "|"))
+	if subtle.ConstantTimeCompare([]byte(signature), []byte(expected)) != 1 {
+		return "", errors.New("state parameter signature mismatch")
+	}
+
+	cookie, err := req.Cookie(stateCookieName)
+	if err != nil {
+		return "", errors.New("missing state cookie")
+	}
+	if subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(nonce)) != 1 {
+		return "", errors.New("state parameter does not match the state cookie")
+	}
+
+	issued, err := strconv.ParseInt(issuedAt, 10, 64)
+	if err != nil {
+		return "", errors.New("malformed state parameter")
+	}
+	if time.Since(time.Unix(issued, 0)) > r.config.OAuthStateTTL {
+		return "", errors.New("state parameter has expired")
+	}
+
+	pathBytes, err := base64.RawURLEncoding.DecodeString(encodedPath)
+	if err != nil {
+		return "", errors.New("malformed state parameter")
+	}
+
+	return strings.TrimPrefix(string(pathBytes), PathParamPrefix), nil
+}
+
+// signStateParam HMAC-signs a state payload with a key derived from the
+// proxy's encryption key via HKDF. The state signing key is deliberately
+// distinct from the raw EncryptionKey used for AES-GCM cookie encryption so
+// the same secret isn't reused across two different cryptographic purposes
+func (r *oauthProxy) signStateParam(payload string) string {
+	mac := hmac.New(sha256.New, r.stateSigningKey())
+	mac.Write([]byte(payload))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// stateSigningKey derives a key for signing the oauth state parameter from
+// the proxy's encryption key via HKDF-SHA256, keyed apart from any other use
+// of EncryptionKey by the "keycloak-proxy-oauth-state" info string
+func (r *oauthProxy) stateSigningKey() []byte {
+	kdf := hkdf.New(sha256.New, []byte(r.config.EncryptionKey), nil, []byte("keycloak-proxy-oauth-state"))
+
+	key := make([]byte, sha256.Size)
+	// @NOTE: hkdf.Read only errors when asked for more bytes than the
+	// underlying hash can expand to, which sha256.Size never triggers
+	io.ReadFull(kdf, key)
+
+	return key
 }
@@ -0,0 +1,111 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newStateTestProxy() *oauthProxy {
+	return &oauthProxy{
+		config: &Config{
+			EncryptionKey: "AgBD6987FqHDB3normzfqHDB3normzfA",
+			OAuthStateTTL: time.Minute,
+		},
+	}
+}
+
+// stateRequestWithCookie generates a state value against a recorder, then
+// replays whatever cookie it set onto a fresh request so pathFromStateParam
+// can be exercised against it
+func stateRequestWithCookie(proxy *oauthProxy, uri string) (string, *http.Request) {
+	rec := httptest.NewRecorder()
+	state := proxy.generateStateParam(rec, uri)
+
+	req := httptest.NewRequest(http.MethodGet, "/oauth/callback", nil)
+	for _, c := range rec.Result().Cookies() {
+		req.AddCookie(c)
+	}
+
+	return state, req
+}
+
+func TestGenerateAndPathFromStateParamRoundTrip(t *testing.T) {
+	proxy := newStateTestProxy()
+
+	state, req := stateRequestWithCookie(proxy, "/some/protected/path")
+
+	got, err := proxy.pathFromStateParam(req, state)
+	if err != nil {
+		t.Fatalf("unexpected error verifying state parameter: %v", err)
+	}
+	if got != "/some/protected/path" {
+		t.Fatalf("expected decoded path to match, got: %s", got)
+	}
+}
+
+func TestPathFromStateParamRejectsTamperedSignature(t *testing.T) {
+	proxy := newStateTestProxy()
+
+	state, req := stateRequestWithCookie(proxy, "/some/path")
+
+	tampered := state[:len(state)-1] + "x"
+	if tampered == state {
+		tampered = state[:len(state)-1] + "y"
+	}
+
+	if _, err := proxy.pathFromStateParam(req, tampered); err == nil {
+		t.Fatalf("expected a tampered state parameter to be rejected")
+	}
+}
+
+func TestPathFromStateParamRejectsMissingCookie(t *testing.T) {
+	proxy := newStateTestProxy()
+
+	rec := httptest.NewRecorder()
+	state := proxy.generateStateParam(rec, "/some/path")
+
+	req := httptest.NewRequest(http.MethodGet, "/oauth/callback", nil)
+
+	if _, err := proxy.pathFromStateParam(req, state); err == nil {
+		t.Fatalf("expected a missing state cookie to be rejected")
+	}
+}
+
+func TestPathFromStateParamRejectsReplayedNonce(t *testing.T) {
+	proxy := newStateTestProxy()
+
+	state, _ := stateRequestWithCookie(proxy, "/first/path")
+	_, req := stateRequestWithCookie(proxy, "/second/path")
+
+	if _, err := proxy.pathFromStateParam(req, state); err == nil {
+		t.Fatalf("expected a state parameter replayed against a different session's cookie to be rejected")
+	}
+}
+
+func TestPathFromStateParamRejectsExpiredState(t *testing.T) {
+	proxy := newStateTestProxy()
+	proxy.config.OAuthStateTTL = -time.Second
+
+	state, req := stateRequestWithCookie(proxy, "/some/path")
+
+	if _, err := proxy.pathFromStateParam(req, state); err == nil {
+		t.Fatalf("expected an expired state parameter to be rejected")
+	}
+}
@@ -0,0 +1,204 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gambol99/go-oidc/jose"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+var (
+	idleExpirationsMetric = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "proxy_idle_session_expirations_total",
+			Help: "The total amount of sessions expired for being idle longer than SessionIdleDuration",
+		},
+	)
+	absoluteExpirationsMetric = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "proxy_absolute_session_expirations_total",
+			Help: "The total amount of sessions expired for reaching the refresh token's absolute lifetime",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(idleExpirationsMetric)
+	prometheus.MustRegister(absoluteExpirationsMetric)
+}
+
+// sessionStore is a pluggable backend for tracking the last time a session
+// id was seen, used to enforce SessionIdleDuration
+type sessionStore interface {
+	// touch records the current time as the last-seen time for id
+	touch(id string) error
+	// lastSeen returns the last-seen time for id, or the zero time if unknown
+	lastSeen(id string) (time.Time, error)
+}
+
+// sessionSweepInterval is how often memorySessionStore scans for and evicts
+// entries older than its ttl, so the map doesn't grow without bound
+const sessionSweepInterval = time.Minute
+
+// memorySessionStore is the default, in-process sessionStore implementation.
+// Entries older than ttl are evicted by a background sweep so the map stays
+// bounded to roughly the set of sessions active within the last ttl
+type memorySessionStore struct {
+	sync.RWMutex
+	seen map[string]time.Time
+	ttl  time.Duration
+}
+
+func newMemorySessionStore(ttl time.Duration) *memorySessionStore {
+	m := &memorySessionStore{seen: make(map[string]time.Time), ttl: ttl}
+	go m.evictExpired()
+
+	return m
+}
+
+func (m *memorySessionStore) touch(id string) error {
+	m.Lock()
+	defer m.Unlock()
+	m.seen[id] = time.Now()
+
+	return nil
+}
+
+func (m *memorySessionStore) lastSeen(id string) (time.Time, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	return m.seen[id], nil
+}
+
+// evictExpired runs for the lifetime of the process, periodically removing
+// last-seen entries older than ttl
+func (m *memorySessionStore) evictExpired() {
+	for range time.Tick(sessionSweepInterval) {
+		m.sweepOnce()
+	}
+}
+
+// sweepOnce removes every last-seen entry older than ttl, a single pass of
+// the eviction loop pulled out so it can be exercised directly in tests
+func (m *memorySessionStore) sweepOnce() {
+	cutoff := time.Now().Add(-m.ttl)
+
+	m.Lock()
+	defer m.Unlock()
+	for id, seen := range m.seen {
+		if seen.Before(cutoff) {
+			delete(m.seen, id)
+		}
+	}
+}
+
+// redisSessionStore is a sessionStore backed by Redis, for proxies running
+// as multiple replicas that need a shared idle-session clock
+type redisSessionStore struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+func newRedisSessionStore(addr string, ttl time.Duration) *redisSessionStore {
+	return &redisSessionStore{
+		client: redis.NewClient(&redis.Options{Addr: addr}),
+		ttl:    ttl,
+	}
+}
+
+func (rs *redisSessionStore) touch(id string) error {
+	return rs.client.Set(context.Background(), "kc-session:"+id, time.Now().Format(time.RFC3339), rs.ttl).Err()
+}
+
+func (rs *redisSessionStore) lastSeen(id string) (time.Time, error) {
+	value, err := rs.client.Get(context.Background(), "kc-session:"+id).Result()
+	if err == redis.Nil {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Parse(time.RFC3339, value)
+}
+
+// checkIdleSession reports whether the session has exceeded the configured
+// idle duration or the refresh token's absolute lifetime, incrementing the
+// appropriate Prometheus counter. The last-seen time is only touched when the
+// session is still alive
+func (r *oauthProxy) checkIdleSession(sessionID string, refreshExpiresAt time.Time) bool {
+	if r.config.SessionIdleDuration <= 0 || r.sessions == nil {
+		return false
+	}
+
+	last, err := r.sessions.lastSeen(sessionID)
+	if err != nil {
+		r.log.Error("failed to read session last-seen time", zap.Error(err), zap.String("id", sessionID))
+		return false
+	}
+
+	idleExpired := !last.IsZero() && time.Since(last) > r.config.SessionIdleDuration
+	if idleExpired {
+		idleExpirationsMetric.Inc()
+		return true
+	}
+	if time.Now().After(refreshExpiresAt) {
+		absoluteExpirationsMetric.Inc()
+		return true
+	}
+
+	if err := r.sessions.touch(sessionID); err != nil {
+		r.log.Error("failed to update session last-seen time", zap.Error(err), zap.String("id", sessionID))
+	}
+
+	return false
+}
+
+// checkRequestIdleSession reads the refresh token cookie for the current
+// request and reports whether the session has exceeded its idle or absolute
+// lifetime. If the session is still alive, it slides the idle deadline
+// forward and re-issues the access token cookie so the browser's copy gets a
+// fresh expiry rather than expiring out from under a still-active session
+func (r *oauthProxy) checkRequestIdleSession(w http.ResponseWriter, req *http.Request, scope *RequestScope) bool {
+	refreshValue, err := readCookie(req, r.config.CookieRefreshName)
+	if err != nil {
+		return false
+	}
+
+	_, ident, err := parseToken(refreshValue)
+	if err != nil {
+		return false
+	}
+
+	if expired := r.checkIdleSession(scope.Identity.ID, ident.ExpiresAt); expired {
+		return true
+	}
+
+	if accessValue, err := r.getAccessTokenFromCookie(req); err == nil {
+		duration := r.getAccessCookieExpiration(jose.JWT{}, refreshValue)
+		r.dropAccessTokenCookie(w, accessValue, duration)
+	}
+
+	return false
+}
@@ -0,0 +1,53 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemorySessionStoreEvictsExpiredEntries(t *testing.T) {
+	store := &memorySessionStore{seen: make(map[string]time.Time), ttl: time.Minute}
+
+	store.seen["stale"] = time.Now().Add(-2 * time.Minute)
+	store.seen["fresh"] = time.Now()
+
+	store.sweepOnce()
+
+	if _, found := store.seen["stale"]; found {
+		t.Fatalf("expected stale entry to be evicted")
+	}
+	if _, found := store.seen["fresh"]; !found {
+		t.Fatalf("expected fresh entry to survive the sweep")
+	}
+}
+
+func TestMemorySessionStoreTouchAndLastSeen(t *testing.T) {
+	store := newMemorySessionStore(time.Minute)
+
+	if err := store.touch("session-1"); err != nil {
+		t.Fatalf("unexpected error touching session: %v", err)
+	}
+
+	seen, err := store.lastSeen("session-1")
+	if err != nil {
+		t.Fatalf("unexpected error reading last-seen: %v", err)
+	}
+	if seen.IsZero() {
+		t.Fatalf("expected a non-zero last-seen time")
+	}
+}
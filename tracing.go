@@ -0,0 +1,120 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/contrib/propagators/b3"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// sensitiveCookieNames returns the cookie names that must never have their
+// values attached to a span, mirroring the filter passed to filterCookies
+func (r *oauthProxy) sensitiveCookieNames() []string {
+	return []string{r.config.CookieAccessName, r.config.CookieRefreshName, stateCookieName}
+}
+
+// censoredCookieNames returns the names (never the values) of the request's
+// cookies that match filter, safe to attach to a span
+func censoredCookieNames(req *http.Request, filter []string) []string {
+	var names []string
+	for _, c := range req.Cookies() {
+		for _, n := range filter {
+			if c.Name == n || (n != "" && len(c.Name) > len(n) && c.Name[:len(n)+1] == n+"_") {
+				names = append(names, c.Name)
+				break
+			}
+		}
+	}
+
+	return names
+}
+
+// subjectFromRequest extracts the authenticated subject from the request
+// scope, if one has been established yet
+func subjectFromRequest(req *http.Request) string {
+	if scope, ok := req.Context().Value(contextScopeName).(*RequestScope); ok && scope.Identity != nil {
+		return scope.Identity.ID
+	}
+
+	return ""
+}
+
+// tracerName identifies the tracer used across the proxy
+const tracerName = "keycloak-proxy"
+
+// newTracerProvider configures the OTLP/HTTP exporter used when
+// EnableTracing is switched on
+func newTracerProvider(endpoint, serviceName string, sampleRate float64) (*sdktrace.TracerProvider, error) {
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpoint(endpoint))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.TraceIDRatioBased(sampleRate)),
+	)
+	otel.SetTracerProvider(provider)
+
+	// @NOTE: both W3C traceparent and B3 are registered so the proxy extracts
+	// and propagates whichever header an upstream or downstream hop is
+	// actually using, rather than forcing everything onto one format
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+		b3.New(b3.WithInjectEncoding(b3.B3MultipleHeader)),
+	))
+
+	return provider, nil
+}
+
+// startRootSpan extracts any incoming W3C traceparent/B3 trace context from
+// the request headers and starts the root span for the request lifecycle
+func (r *oauthProxy) startRootSpan(req *http.Request) (context.Context, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+
+	return otel.Tracer(tracerName).Start(ctx, req.Method+" "+req.URL.Path)
+}
+
+// startChildSpan starts a child span under the request's root span, tagging
+// it with the decision the helper took, why, the authenticated subject (when
+// known) and the names (never values) of any cookies filterCookies would
+// censor
+func (r *oauthProxy) startChildSpan(req *http.Request, name, decision, reason string) (context.Context, trace.Span) {
+	ctx, span := otel.Tracer(tracerName).Start(req.Context(), name)
+	span.SetAttributes(
+		attribute.String("keycloak_proxy.decision", decision),
+		attribute.String("keycloak_proxy.reason", reason),
+		attribute.String("keycloak_proxy.subject", subjectFromRequest(req)),
+		attribute.StringSlice("keycloak_proxy.censored_cookies", censoredCookieNames(req, r.sensitiveCookieNames())),
+	)
+
+	return ctx, span
+}
+
+// injectTraceContext writes the current span context into the upstream
+// request headers so the reverse proxy propagates the trace
+func injectTraceContext(ctx context.Context, req *http.Request) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// unixSocketScheme is the scheme used to address a unix-socket upstream,
+// e.g. unix:///var/run/app.sock
+const unixSocketScheme = "unix://"
+
+// defaultUnixSocketHost is the Host header used when proxying to a unix
+// socket upstream, unless overridden
+const defaultUnixSocketHost = "localhost"
+
+// isUnixSocketUpstream returns true if the configured upstream targets a
+// unix domain socket rather than a TCP address
+func isUnixSocketUpstream(upstream string) bool {
+	return strings.HasPrefix(upstream, unixSocketScheme)
+}
+
+// unixSocketPath strips the unix:// scheme from the upstream, returning the
+// filesystem path to the socket
+func unixSocketPath(upstream string) string {
+	return strings.TrimPrefix(upstream, unixSocketScheme)
+}
+
+// newUnixSocketTransport returns an http.Transport that dials the given unix
+// socket path for every request, irrespective of the request's Host
+func newUnixSocketTransport(socketPath string) *http.Transport {
+	return &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socketPath)
+		},
+	}
+}
+
+// newReverseProxy builds the httputil.ReverseProxy used to forward requests
+// to the configured upstream, transparently dialing a unix domain socket and
+// rewriting the Host header when the upstream is addressed as unix://...
+func (r *oauthProxy) newReverseProxy() (*httputil.ReverseProxy, error) {
+	if err := r.validateEncryptionConfig(); err != nil {
+		return nil, err
+	}
+
+	upstream := r.config.Upstream
+
+	if !isUnixSocketUpstream(upstream) {
+		upstreamURL, err := url.Parse(upstream)
+		if err != nil {
+			return nil, err
+		}
+
+		proxy := httputil.NewSingleHostReverseProxy(upstreamURL)
+		baseDirector := proxy.Director
+		proxy.Director = func(req *http.Request) {
+			baseDirector(req)
+			r.injectTraceContextIfEnabled(req)
+		}
+
+		return proxy, nil
+	}
+
+	host := r.config.UnixSocketHost
+	if host == "" {
+		host = defaultUnixSocketHost
+	}
+
+	return &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = "http"
+			req.URL.Host = host
+			req.Host = host
+			r.injectTraceContextIfEnabled(req)
+		},
+		Transport: newUnixSocketTransport(unixSocketPath(upstream)),
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			r.upstreamUnavailable(w, req, err)
+		},
+	}, nil
+}
+
+// injectTraceContextIfEnabled propagates the current span context into the
+// upstream request headers when tracing is switched on
+func (r *oauthProxy) injectTraceContextIfEnabled(req *http.Request) {
+	if r.config.EnableTracing {
+		injectTraceContext(req.Context(), req)
+	}
+}
+
+// upstreamUnavailable is responsible for surfacing a reverse-proxy dial
+// failure to the client as a 502, analogous to accessForbidden
+func (r *oauthProxy) upstreamUnavailable(w http.ResponseWriter, req *http.Request, err error) context.Context {
+	_, span := r.startChildSpan(req, "upstreamUnavailable", "forbidden", "upstream dial failed")
+	defer span.End()
+
+	r.log.Error("failed to dial upstream", zap.Error(err), zap.String("upstream", r.config.Upstream))
+	w.WriteHeader(http.StatusBadGateway)
+
+	return r.revokeProxy(w, req)
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// newUnixSocketBackedServer starts an httptest-style server listening on a
+// temporary unix domain socket instead of a TCP port
+func newUnixSocketBackedServer(t *testing.T, handler http.Handler) (*httptest.Server, string) {
+	socketPath := filepath.Join(t.TempDir(), "upstream.sock")
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("failed to listen on unix socket: %v", err)
+	}
+
+	server := &httptest.Server{Listener: listener, Config: &http.Server{Handler: handler}}
+	server.Start()
+
+	return server, socketPath
+}
+
+func TestNewReverseProxyUnixSocket(t *testing.T) {
+	backend, socketPath := newUnixSocketBackedServer(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, "host=%s", req.Host)
+	}))
+	defer backend.Close()
+
+	proxy := &oauthProxy{
+		config: &Config{
+			Upstream:      "unix://" + socketPath,
+			EncryptionKey: "AgBD6987FqHDB3normzfqHDB3normzfA",
+		},
+	}
+
+	reverseProxy, err := proxy.newReverseProxy()
+	if err != nil {
+		t.Fatalf("unexpected error building reverse proxy: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://proxy.example.com/", nil)
+	rec := httptest.NewRecorder()
+
+	reverseProxy.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if got, want := rec.Body.String(), "host="+defaultUnixSocketHost; got != want {
+		t.Fatalf("expected Host to be rewritten to %q, got %q", want, got)
+	}
+}
+
+func TestIsUnixSocketUpstream(t *testing.T) {
+	if !isUnixSocketUpstream("unix:///var/run/app.sock") {
+		t.Fatalf("expected unix:// upstream to be detected")
+	}
+	if isUnixSocketUpstream("https://backend.internal") {
+		t.Fatalf("did not expect http(s):// upstream to be detected as a unix socket")
+	}
+}
@@ -0,0 +1,349 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	umaGrantType     = "urn:ietf:params:oauth:grant-type:uma-ticket"
+	umaProtectionURI = "/authz/protection/resource_set"
+	umaPermissionURI = "/authz/protection/permission"
+)
+
+// patToken holds the Protection API Token used to talk to the Keycloak
+// protection endpoints, refreshed in the background before it expires
+type patToken struct {
+	sync.RWMutex
+	token     string
+	expiresAt time.Time
+}
+
+// rptCacheEntry is a cached RPT for a given subject/resource/scope tuple
+type rptCacheEntry struct {
+	token     string
+	expiresAt time.Time
+}
+
+// umaResource is the subset of a Keycloak resource_set we care about
+type umaResource struct {
+	ID   string `json:"_id"`
+	Name string `json:"name"`
+}
+
+// rptResponse is the subset of an RPT response we need
+type rptResponse struct {
+	AccessToken string `json:"access_token"`
+}
+
+// getPAT returns a valid Protection API Token, refreshing it if required
+func (r *oauthProxy) getPAT() (string, error) {
+	r.pat.RLock()
+	if r.pat.token != "" && time.Now().Before(r.pat.expiresAt) {
+		token := r.pat.token
+		r.pat.RUnlock()
+		return token, nil
+	}
+	r.pat.RUnlock()
+
+	return r.refreshPAT()
+}
+
+// refreshPAT obtains a fresh Protection API Token via client_credentials. The
+// Keycloak round-trip is performed without holding the pat lock so that
+// concurrent getPAT() readers aren't stalled for the duration of the request
+func (r *oauthProxy) refreshPAT() (string, error) {
+	values := url.Values{}
+	values.Set("grant_type", "client_credentials")
+	values.Set("client_id", r.config.PatClientID)
+	values.Set("client_secret", r.config.PatClientSecret)
+
+	token, expiresIn, err := r.requestUMAToken(values)
+	if err != nil {
+		return "", err
+	}
+
+	r.pat.Lock()
+	r.pat.token = token
+	r.pat.expiresAt = time.Now().Add(time.Duration(expiresIn) * time.Second)
+	r.pat.Unlock()
+
+	return token, nil
+}
+
+// patRefreshLoop is run as a background goroutine and keeps the PAT fresh
+func (r *oauthProxy) patRefreshLoop(done <-chan struct{}) {
+	r.log.Info("starting the uma protection api token refresh loop")
+
+	for {
+		select {
+		case <-time.After(patRefreshInterval):
+			if _, err := r.refreshPAT(); err != nil {
+				r.log.Error("failed to refresh the protection api token", zap.Error(err))
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+const patRefreshInterval = 30 * time.Second
+
+// lookupResource queries the Keycloak Protection API for the resource
+// registered against the given request path
+func (r *oauthProxy) lookupResource(pat, path string) (*umaResource, error) {
+	uri := fmt.Sprintf("%s%s?uri=%s&matchingUri=true", r.config.DiscoveryURL, umaProtectionURI, url.QueryEscape(path))
+
+	req, err := http.NewRequest(http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+pat)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("protection api returned status: %d", resp.StatusCode)
+	}
+
+	var resources []umaResource
+	if err := json.NewDecoder(resp.Body).Decode(&resources); err != nil {
+		return nil, err
+	}
+	if len(resources) == 0 {
+		return nil, fmt.Errorf("no resource registered for path: %s", path)
+	}
+
+	return &resources[0], nil
+}
+
+// scopeForMethod maps an HTTP method to the UMA scope configured for it
+func (r *oauthProxy) scopeForMethod(method string) string {
+	if scope, found := r.config.UmaMethodScopes[method]; found {
+		return scope
+	}
+
+	return r.config.UmaMethodScopes["*"]
+}
+
+// getRPT returns a cached or freshly negotiated RPT for the subject against
+// the resource_id#scope pair, caching it until the token's exp claim
+func (r *oauthProxy) getRPT(subject, resourceID, scope string) (string, error) {
+	cacheKey := strings.Join([]string{subject, resourceID, scope}, "|")
+
+	r.rptCacheLock.RLock()
+	if entry, found := r.rptCache[cacheKey]; found && time.Now().Before(entry.expiresAt) {
+		r.rptCacheLock.RUnlock()
+		return entry.token, nil
+	}
+	r.rptCacheLock.RUnlock()
+
+	pat, err := r.getPAT()
+	if err != nil {
+		return "", err
+	}
+
+	values := url.Values{}
+	values.Set("grant_type", umaGrantType)
+	values.Set("permission", fmt.Sprintf("%s#%s", resourceID, scope))
+	values.Set("audience", r.config.ClientID)
+
+	req, err := http.NewRequest(http.MethodPost, r.config.DiscoveryURL+tokenURI, strings.NewReader(values.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+pat)
+
+	token, _, err := r.requestRPT(req)
+	if err != nil {
+		return "", err
+	}
+
+	_, ident, err := parseToken(token)
+	if err != nil {
+		return "", err
+	}
+
+	r.rptCacheLock.Lock()
+	r.rptCache[cacheKey] = &rptCacheEntry{token: token, expiresAt: ident.ExpiresAt}
+	r.rptCacheLock.Unlock()
+
+	return token, nil
+}
+
+// requestUMAToken performs the client_credentials grant against the token endpoint
+func (r *oauthProxy) requestUMAToken(values url.Values) (string, int, error) {
+	resp, err := http.PostForm(r.config.DiscoveryURL+tokenURI, values)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("token endpoint returned status: %d", resp.StatusCode)
+	}
+
+	var payload struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return "", 0, err
+	}
+
+	return payload.AccessToken, payload.ExpiresIn, nil
+}
+
+// requestRPT submits the uma-ticket grant and returns the RPT access token
+func (r *oauthProxy) requestRPT(req *http.Request) (string, int, error) {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("token endpoint returned status: %d", resp.StatusCode)
+	}
+
+	var payload rptResponse
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return "", 0, err
+	}
+
+	return payload.AccessToken, 0, nil
+}
+
+// permissionTicketRequest is the body submitted to the permission endpoint to
+// mint a ticket for a resource_id/scope pair
+type permissionTicketRequest struct {
+	ResourceID     string   `json:"resource_id"`
+	ResourceScopes []string `json:"resource_scopes"`
+}
+
+// permissionTicketResponse is the ticket minted by the permission endpoint
+type permissionTicketResponse struct {
+	Ticket string `json:"ticket"`
+}
+
+// requestPermissionTicket asks the Keycloak Protection API to mint an opaque
+// ticket for the resource/scope pair, for use in a WWW-Authenticate
+// challenge. The ticket is not the resource ID - the client must present it
+// back to the token endpoint to obtain an RPT
+func (r *oauthProxy) requestPermissionTicket(pat, resourceID, scope string) (string, error) {
+	body, err := json.Marshal([]permissionTicketRequest{{ResourceID: resourceID, ResourceScopes: []string{scope}}})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, r.config.DiscoveryURL+umaPermissionURI, strings.NewReader(string(body)))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+pat)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("permission endpoint returned status: %d", resp.StatusCode)
+	}
+
+	var payload permissionTicketResponse
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return "", err
+	}
+
+	return payload.Ticket, nil
+}
+
+// umaAuthorized is responsible for enforcing the UMA resource/scope check for
+// the current request. It performs no role/claim checks of its own and does
+// not look at EnableUma; entrypointMiddleware only calls it when UMA is
+// switched on. It requires the verified identity the authentication
+// middleware places on RequestScope, so entrypointMiddleware must be mounted
+// after that middleware in the proxy chain
+func (r *oauthProxy) umaAuthorized(w http.ResponseWriter, req *http.Request) context.Context {
+	_, span := r.startChildSpan(req, "umaAuthorized", "pending", "uma resource/scope check")
+	defer span.End()
+
+	scope, ok := req.Context().Value(contextScopeName).(*RequestScope)
+	if !ok || scope.Identity == nil {
+		r.log.Error("uma authorization requires a verified identity on the request scope")
+		return r.accessForbidden(w, req)
+	}
+
+	pat, err := r.getPAT()
+	if err != nil {
+		r.log.Error("failed to obtain protection api token", zap.Error(err))
+		return r.accessForbidden(w, req)
+	}
+
+	resource, err := r.lookupResource(pat, req.URL.Path)
+	if err != nil {
+		r.log.Error("failed to lookup uma resource", zap.Error(err), zap.String("path", req.URL.Path))
+		return r.accessForbidden(w, req)
+	}
+
+	resourceScope := r.scopeForMethod(req.Method)
+
+	rpt, err := r.getRPT(scope.Identity.ID, resource.ID, resourceScope)
+	if err != nil {
+		r.log.Warn("denying uma authorization, issuing ticket challenge",
+			zap.Error(err), zap.String("resource", resource.Name))
+
+		ticket, ticketErr := r.requestPermissionTicket(pat, resource.ID, resourceScope)
+		if ticketErr != nil {
+			r.log.Error("failed to mint uma permission ticket", zap.Error(ticketErr))
+			return r.accessForbidden(w, req)
+		}
+
+		return r.umaChallenge(w, req, ticket)
+	}
+
+	scope.Identity.Token.Encoded = rpt
+
+	return req.Context()
+}
+
+// umaChallenge emits the WWW-Authenticate UMA challenge header required by
+// the spec so that clients know how to obtain an RPT for the ticket minted by
+// requestPermissionTicket
+func (r *oauthProxy) umaChallenge(w http.ResponseWriter, req *http.Request, ticket string) context.Context {
+	challenge := fmt.Sprintf(`UMA realm=%q, as_uri=%q, ticket=%q`, r.config.Realm, r.config.DiscoveryURL, ticket)
+	w.Header().Set("WWW-Authenticate", challenge)
+
+	return r.accessForbidden(w, req)
+}
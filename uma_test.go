@@ -0,0 +1,113 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newFakeKeycloakUMAServer stands in for a Keycloak realm supporting the
+// client_credentials, resource_set and permission endpoints exercised by
+// uma.go
+func newFakeKeycloakUMAServer(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc(tokenURI, func(w http.ResponseWriter, req *http.Request) {
+		if err := req.ParseForm(); err != nil {
+			t.Fatalf("failed to parse token request: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "fake-pat-token",
+			"expires_in":   60,
+		})
+	})
+
+	mux.HandleFunc(umaProtectionURI, func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer fake-pat-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode([]umaResource{{ID: "resource-1", Name: "/api/widgets"}})
+	})
+
+	mux.HandleFunc(umaPermissionURI, func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(permissionTicketResponse{Ticket: "fake-ticket"})
+	})
+
+	return httptest.NewServer(mux)
+}
+
+func TestGetPATAndLookupResource(t *testing.T) {
+	server := newFakeKeycloakUMAServer(t)
+	defer server.Close()
+
+	proxy := &oauthProxy{
+		config: &Config{
+			DiscoveryURL:    server.URL,
+			PatClientID:     "protection-client",
+			PatClientSecret: "protection-secret",
+		},
+	}
+
+	pat, err := proxy.getPAT()
+	if err != nil {
+		t.Fatalf("unexpected error obtaining pat: %v", err)
+	}
+	if pat != "fake-pat-token" {
+		t.Fatalf("expected fake-pat-token, got: %s", pat)
+	}
+
+	resource, err := proxy.lookupResource(pat, "/api/widgets")
+	if err != nil {
+		t.Fatalf("unexpected error looking up resource: %v", err)
+	}
+	if resource.ID != "resource-1" {
+		t.Fatalf("expected resource-1, got: %s", resource.ID)
+	}
+}
+
+func TestRequestPermissionTicket(t *testing.T) {
+	server := newFakeKeycloakUMAServer(t)
+	defer server.Close()
+
+	proxy := &oauthProxy{
+		config: &Config{
+			DiscoveryURL:    server.URL,
+			PatClientID:     "protection-client",
+			PatClientSecret: "protection-secret",
+		},
+	}
+
+	pat, err := proxy.getPAT()
+	if err != nil {
+		t.Fatalf("unexpected error obtaining pat: %v", err)
+	}
+
+	ticket, err := proxy.requestPermissionTicket(pat, "resource-1", "view")
+	if err != nil {
+		t.Fatalf("unexpected error requesting permission ticket: %v", err)
+	}
+	if ticket != "fake-ticket" {
+		t.Fatalf("expected fake-ticket, got: %s", ticket)
+	}
+}